@@ -0,0 +1,192 @@
+// Copyright 2024 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package linux
+
+// VFIO type and base, from <linux/vfio.h>.
+const (
+	vfioType = uint32(';')
+	vfioBase = 100
+)
+
+// IO returns the ioctl request number for a "no argument" ioctl of the given
+// type and sequence number, per the _IO() macro in <asm-generic/ioctl.h>.
+func IO(typ, nr uint32) uint32 {
+	return typ<<8 | nr
+}
+
+// VFIO ioctl commands, from <linux/vfio.h>.
+var (
+	VFIO_GET_API_VERSION        = IO(vfioType, vfioBase+0)
+	VFIO_CHECK_EXTENSION        = IO(vfioType, vfioBase+1)
+	VFIO_SET_IOMMU              = IO(vfioType, vfioBase+2)
+	VFIO_GROUP_GET_STATUS       = IO(vfioType, vfioBase+3)
+	VFIO_GROUP_SET_CONTAINER    = IO(vfioType, vfioBase+4)
+	VFIO_GROUP_UNSET_CONTAINER  = IO(vfioType, vfioBase+5)
+	VFIO_GROUP_GET_DEVICE_FD    = IO(vfioType, vfioBase+6)
+	VFIO_DEVICE_GET_INFO        = IO(vfioType, vfioBase+7)
+	VFIO_DEVICE_GET_REGION_INFO = IO(vfioType, vfioBase+8)
+	VFIO_DEVICE_GET_IRQ_INFO    = IO(vfioType, vfioBase+9)
+	VFIO_DEVICE_SET_IRQS        = IO(vfioType, vfioBase+10)
+	VFIO_DEVICE_RESET           = IO(vfioType, vfioBase+11)
+	VFIO_IOMMU_GET_INFO         = IO(vfioType, vfioBase+12)
+	VFIO_IOMMU_MAP_DMA          = IO(vfioType, vfioBase+13)
+	VFIO_IOMMU_UNMAP_DMA        = IO(vfioType, vfioBase+14)
+)
+
+// VFIO_API_VERSION is the value returned by a successful VFIO_GET_API_VERSION
+// ioctl.
+const VFIO_API_VERSION = 0
+
+// VFIO extensions, reported by VFIO_CHECK_EXTENSION.
+const (
+	VFIO_TYPE1_IOMMU     = 1
+	VFIO_SPAPR_TCE_IOMMU = 2
+	VFIO_TYPE1v2_IOMMU   = 3
+)
+
+// Flags for VFIOGroupStatus.Flags.
+const (
+	VFIO_GROUP_FLAGS_VIABLE        = 1 << 0
+	VFIO_GROUP_FLAGS_CONTAINER_SET = 1 << 1
+)
+
+// VFIOGroupStatus implements struct vfio_group_status, from
+// <linux/vfio.h>.
+//
+// +marshal
+type VFIOGroupStatus struct {
+	ArgSz uint32
+	Flags uint32
+}
+
+// Flags for VFIODeviceInfo.Flags.
+const (
+	VFIO_DEVICE_FLAGS_RESET    = 1 << 0
+	VFIO_DEVICE_FLAGS_PCI      = 1 << 1
+	VFIO_DEVICE_FLAGS_PLATFORM = 1 << 2
+	VFIO_DEVICE_FLAGS_AMBA     = 1 << 3
+	VFIO_DEVICE_FLAGS_CCW      = 1 << 4
+	VFIO_DEVICE_FLAGS_AP       = 1 << 5
+)
+
+// VFIODeviceInfo implements struct vfio_device_info, from
+// <linux/vfio.h>.
+//
+// +marshal
+type VFIODeviceInfo struct {
+	ArgSz      uint32
+	Flags      uint32
+	NumRegions uint32
+	NumIrqs    uint32
+}
+
+// Flags for VFIORegionInfo.Flags.
+const (
+	VFIO_REGION_INFO_FLAG_READ  = 1 << 0
+	VFIO_REGION_INFO_FLAG_WRITE = 1 << 1
+	VFIO_REGION_INFO_FLAG_MMAP  = 1 << 2
+	VFIO_REGION_INFO_FLAG_CAPS  = 1 << 3
+)
+
+// VFIORegionInfo implements struct vfio_region_info, from
+// <linux/vfio.h>.
+//
+// +marshal
+type VFIORegionInfo struct {
+	ArgSz     uint32
+	Flags     uint32
+	Index     uint32
+	CapOffset uint32
+	Size      uint64
+	Offset    uint64
+}
+
+// Flags for VFIOIrqInfo.Flags and VFIOIrqSet.Flags.
+const (
+	VFIO_IRQ_INFO_EVENTFD    = 1 << 0
+	VFIO_IRQ_INFO_MASKABLE   = 1 << 1
+	VFIO_IRQ_INFO_AUTOMASKED = 1 << 2
+	VFIO_IRQ_INFO_NORESIZE   = 1 << 3
+
+	VFIO_IRQ_SET_DATA_NONE      = 1 << 0
+	VFIO_IRQ_SET_DATA_BOOL      = 1 << 1
+	VFIO_IRQ_SET_DATA_EVENTFD   = 1 << 2
+	VFIO_IRQ_SET_ACTION_MASK    = 1 << 3
+	VFIO_IRQ_SET_ACTION_UNMASK  = 1 << 4
+	VFIO_IRQ_SET_ACTION_TRIGGER = 1 << 5
+)
+
+// VFIOIrqInfo implements struct vfio_irq_info, from <linux/vfio.h>.
+//
+// +marshal
+type VFIOIrqInfo struct {
+	ArgSz uint32
+	Flags uint32
+	Index uint32
+	Count uint32
+}
+
+// VFIOIrqSet implements the fixed-size header of struct vfio_irq_set, from
+// <linux/vfio.h>. The variable-length `data` field that follows is handled
+// separately by the caller, since its size and interpretation depend on
+// Flags.
+//
+// +marshal
+type VFIOIrqSet struct {
+	ArgSz uint32
+	Flags uint32
+	Index uint32
+	Start uint32
+	Count uint32
+}
+
+// VFIOIommuType1Info implements struct vfio_iommu_type1_info, from
+// <linux/vfio.h>.
+//
+// +marshal
+type VFIOIommuType1Info struct {
+	ArgSz       uint32
+	Flags       uint32
+	IOVAPgsizes uint64
+}
+
+// Flags for VFIOIommuType1DmaMap.Flags.
+const (
+	VFIO_DMA_MAP_FLAG_READ  = 1 << 0
+	VFIO_DMA_MAP_FLAG_WRITE = 1 << 1
+)
+
+// VFIOIommuType1DmaMap implements struct vfio_iommu_type1_dma_map, from
+// <linux/vfio.h>.
+//
+// +marshal
+type VFIOIommuType1DmaMap struct {
+	ArgSz uint32
+	Flags uint32
+	Vaddr uint64
+	IOVA  uint64
+	Size  uint64
+}
+
+// VFIOIommuType1DmaUnmap implements struct vfio_iommu_type1_dma_unmap, from
+// <linux/vfio.h>.
+//
+// +marshal
+type VFIOIommuType1DmaUnmap struct {
+	ArgSz uint32
+	Flags uint32
+	IOVA  uint64
+	Size  uint64
+}
@@ -0,0 +1,174 @@
+// Copyright 2024 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tpuproxy
+
+import (
+	"sync"
+
+	"golang.org/x/sys/unix"
+	"gvisor.dev/gvisor/pkg/errors/linuxerr"
+	"gvisor.dev/gvisor/pkg/hostarch"
+	"gvisor.dev/gvisor/pkg/safemem"
+	"gvisor.dev/gvisor/pkg/sentry/memmap"
+)
+
+// hostFDMmapEntry is a single cached host mmap(2) of a memmap.FileRange.
+// data is nil until the first MapInternal call for fr; refs tracks the
+// memmap.File.IncRef/DecRef pins on fr, which govern the entry's lifetime
+// independently of how many times (if any) MapInternal is called for it.
+type hostFDMmapEntry struct {
+	fr   memmap.FileRange
+	at   hostarch.AccessType
+	data []byte
+	refs int32
+}
+
+// hostFDMmapCache lazily mmaps ranges of a host device FD on first
+// MapInternal request per memmap.FileRange, and unmaps them once the
+// IncRef/DecRef pins backing the range (tracked here via incRef/decRef) drop
+// to zero. It is used by memmap.File implementations backed by host device
+// FDs (TPU device FDs and VFIO device FDs) whose MMIO regions cannot simply be read
+// or written through the host FD, but must be mapped into the sentry's
+// address space to be accessed.
+//
+// hostFDMmapCache is safe for concurrent use.
+type hostFDMmapCache struct {
+	mu sync.Mutex
+
+	// entries is indexed by FileRange; lookups are linear since the number
+	// of distinct ranges pinned for a single device FD is expected to be
+	// small (typically one per BAR).
+	entries []*hostFDMmapEntry
+}
+
+// incRef implements (part of) memmap.File.IncRef: it registers a reference
+// on fr, creating a not-yet-mapped entry for it if one doesn't already
+// exist.
+func (c *hostFDMmapCache) incRef(fr memmap.FileRange) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, e := range c.entries {
+		if e.fr == fr {
+			e.refs++
+			return
+		}
+	}
+	c.entries = append(c.entries, &hostFDMmapEntry{fr: fr, refs: 1})
+}
+
+// decRef implements memmap.File.DecRef: it releases one reference on fr,
+// unmapping and discarding the entry once its last reference is dropped.
+func (c *hostFDMmapCache) decRef(fr memmap.FileRange) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, e := range c.entries {
+		if e.fr == fr {
+			e.refs--
+			if e.refs == 0 {
+				c.removeLocked(i)
+			}
+			return
+		}
+	}
+}
+
+// mapInternal returns a safemem.BlockSeq over a host mapping of fr in
+// hostFD, creating the mapping on first use for an fr already pinned via
+// incRef. It returns linuxerr.EINVAL if fr has no pin registered via incRef,
+// or if the host rejects the mapping (e.g. because the underlying region is
+// not mappable).
+//
+// The first mapInternal call for a given fr greedily maps it
+// read+write, so that a later call requesting a subset of that access (the
+// common case) is always satisfied by the existing mapping. Only if the host
+// rejects the read+write mapping (e.g. a read-only BAR) does mapInternal
+// fall back to the narrower access actually requested; in that case, a still
+// later call requesting wider access will replace the mapping outright.
+// Callers requesting wider access than any prior call for the same fr must
+// ensure no concurrent use of a safemem.BlockSeq this method previously
+// returned for that fr, since the underlying mapping may be munmapped out
+// from under it.
+//
+// mapInternal does not itself affect fr's reference count: callers must
+// pair memmap.File.IncRef/DecRef around their use of the returned mapping,
+// per the memmap.File interface contract.
+func (c *hostFDMmapCache) mapInternal(hostFD int32, fr memmap.FileRange, at hostarch.AccessType) (safemem.BlockSeq, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var e *hostFDMmapEntry
+	for _, candidate := range c.entries {
+		if candidate.fr == fr {
+			e = candidate
+			break
+		}
+	}
+	if e == nil {
+		// The caller should have pinned fr with IncRef before mapping it.
+		return safemem.BlockSeq{}, linuxerr.EINVAL
+	}
+	if e.data != nil && (!at.Read || e.at.Read) && (!at.Write || e.at.Write) {
+		return safemem.BlockSeqOf(safemem.BlockFromSafeSlice(e.data)), nil
+	}
+
+	// Either there is no mapping yet, or the existing one doesn't cover the
+	// requested access. Map with the broadest access we can get away with:
+	// read+write on first use, so that later calls for a subset of that
+	// access never need to replace the mapping; otherwise the union of the
+	// existing and requested access.
+	union := hostarch.AccessType{Read: true, Write: true}
+	if e.data != nil {
+		union.Read = at.Read || e.at.Read
+		union.Write = at.Write || e.at.Write
+	}
+	data, err := mmapHostFDRange(hostFD, fr, union)
+	if err != nil && e.data == nil && union != at {
+		union = at
+		data, err = mmapHostFDRange(hostFD, fr, union)
+	}
+	if err != nil {
+		// Only non-mappable regions (e.g. BARs the host VFIO driver refuses
+		// to mmap) should reach here; anything else is a genuine failure
+		// that callers need to see.
+		return safemem.BlockSeq{}, linuxerr.EINVAL
+	}
+	if e.data != nil {
+		unix.Munmap(e.data)
+	}
+	e.at = union
+	e.data = data
+	return safemem.BlockSeqOf(safemem.BlockFromSafeSlice(data)), nil
+}
+
+// mmapHostFDRange mmaps fr of hostFD with the given access.
+func mmapHostFDRange(hostFD int32, fr memmap.FileRange, at hostarch.AccessType) ([]byte, error) {
+	prot := 0
+	if at.Read {
+		prot |= unix.PROT_READ
+	}
+	if at.Write {
+		prot |= unix.PROT_WRITE
+	}
+	return unix.Mmap(int(hostFD), int64(fr.Start), int(fr.Length()), prot, unix.MAP_SHARED)
+}
+
+// removeLocked unmaps (if mapped) and removes c.entries[i]. c.mu must be
+// locked.
+func (c *hostFDMmapCache) removeLocked(i int) {
+	if data := c.entries[i].data; data != nil {
+		unix.Munmap(data)
+	}
+	c.entries = append(c.entries[:i], c.entries[i+1:]...)
+}
@@ -16,9 +16,7 @@ package tpuproxy
 
 import (
 	"gvisor.dev/gvisor/pkg/context"
-	"gvisor.dev/gvisor/pkg/errors/linuxerr"
 	"gvisor.dev/gvisor/pkg/hostarch"
-	"gvisor.dev/gvisor/pkg/log"
 	"gvisor.dev/gvisor/pkg/safemem"
 	"gvisor.dev/gvisor/pkg/sentry/memmap"
 	"gvisor.dev/gvisor/pkg/sentry/vfs"
@@ -62,20 +60,23 @@ func (fd *tpuFD) InvalidateUnsavable(ctx context.Context) error {
 
 type tpuFDMemmapFile struct {
 	fd *tpuFD
+
+	mapCache hostFDMmapCache
 }
 
 // IncRef implements memmap.File.IncRef.
-func (mf *tpuFDMemmapFile) IncRef(memmap.FileRange, uint32) {
+func (mf *tpuFDMemmapFile) IncRef(fr memmap.FileRange, _ uint32) {
+	mf.mapCache.incRef(fr)
 }
 
 // DecRef implements memmap.File.DecRef.
 func (mf *tpuFDMemmapFile) DecRef(fr memmap.FileRange) {
+	mf.mapCache.decRef(fr)
 }
 
 // MapInternal implements memmap.File.MapInternal.
 func (mf *tpuFDMemmapFile) MapInternal(fr memmap.FileRange, at hostarch.AccessType) (safemem.BlockSeq, error) {
-	log.Traceback("tpuproxy: rejecting tpuFdMemmapFile.MapInternal")
-	return safemem.BlockSeq{}, linuxerr.EINVAL
+	return mf.mapCache.mapInternal(mf.fd.hostFD, fr, at)
 }
 
 // FD implements memmap.File.FD.
@@ -121,20 +122,23 @@ func (fd *pciDeviceFD) InvalidateUnsavable(ctx context.Context) error {
 
 type pciDeviceFdMemmapFile struct {
 	fd *pciDeviceFD
+
+	mapCache hostFDMmapCache
 }
 
 // IncRef implements memmap.File.IncRef.
-func (mf *pciDeviceFdMemmapFile) IncRef(memmap.FileRange, uint32) {
+func (mf *pciDeviceFdMemmapFile) IncRef(fr memmap.FileRange, _ uint32) {
+	mf.mapCache.incRef(fr)
 }
 
 // DecRef implements memmap.File.DecRef.
 func (mf *pciDeviceFdMemmapFile) DecRef(fr memmap.FileRange) {
+	mf.mapCache.decRef(fr)
 }
 
 // MapInternal implements memmap.File.MapInternal.
 func (mf *pciDeviceFdMemmapFile) MapInternal(fr memmap.FileRange, at hostarch.AccessType) (safemem.BlockSeq, error) {
-	log.Traceback("tpuproxy: rejecting pciDeviceFdMemmapFile.MapInternal")
-	return safemem.BlockSeq{}, linuxerr.EINVAL
+	return mf.mapCache.mapInternal(mf.fd.hostFD, fr, at)
 }
 
 // FD implements memmap.File.FD.
@@ -16,6 +16,7 @@ package tpuproxy
 
 import (
 	"fmt"
+	"sync"
 
 	"golang.org/x/sys/unix"
 	"gvisor.dev/gvisor/pkg/abi/linux"
@@ -41,10 +42,41 @@ type vfioFd struct {
 	device     *vfioDevice
 	queue      waiter.Queue
 	memmapFile vfioFDMemmapFile
+
+	// mu protects iommuType.
+	mu sync.Mutex
+
+	// iommuType is the IOMMU model set via VFIO_SET_IOMMU, or 0 if none has
+	// been set yet.
+	iommuType int32
+
+	// dmaMu protects dmaMappings.
+	dmaMu sync.Mutex
+
+	// dmaMappings tracks IOVA ranges currently mapped into this container via
+	// VFIO_IOMMU_MAP_DMA, ordered by increasing IOVA, so that
+	// VFIO_IOMMU_UNMAP_DMA and Release can find and release the pins backing
+	// them.
+	dmaMappings []*vfioDMAMapping
 }
 
 // Release implements vfs.FileDescriptionImpl.Release.
 func (fd *vfioFd) Release(context.Context) {
+	fd.dmaMu.Lock()
+	for _, m := range fd.dmaMappings {
+		unmap := linux.VFIOIommuType1DmaUnmap{
+			ArgSz: uint32(linux.VFIOIommuType1DmaUnmap{}.SizeBytes()),
+			IOVA:  m.iova,
+			Size:  m.size,
+		}
+		if _, err := ioctlInvoke[*linux.VFIOIommuType1DmaUnmap](fd.hostFd, linux.VFIO_IOMMU_UNMAP_DMA, &unmap); err != nil {
+			log.Warningf("release VFIO IOMMU unmap DMA iova=%#x size=%#x: %v", m.iova, m.size, err)
+		}
+		m.unpin()
+	}
+	fd.dmaMappings = nil
+	fd.dmaMu.Unlock()
+
 	fdnotifier.RemoveFD(fd.hostFd)
 	fd.queue.Notify(waiter.EventHUp)
 	unix.Close(int(fd.hostFd))
@@ -86,12 +118,47 @@ func (fd *vfioFd) Ioctl(ctx context.Context, uio usermem.IO, sysno uintptr, args
 		panic("Ioctl should be called from a task context")
 	}
 	switch cmd {
+	case linux.VFIO_GET_API_VERSION:
+		return fd.getAPIVersion()
 	case linux.VFIO_CHECK_EXTENSION:
 		return fd.checkExtension(extension(args[2].Int()))
+	case linux.VFIO_SET_IOMMU:
+		return fd.setIOMMU(extension(args[2].Int()))
+	case linux.VFIO_IOMMU_GET_INFO:
+		return fd.iommuGetInfo(t, args)
+	case linux.VFIO_IOMMU_MAP_DMA:
+		return fd.iommuMapDMA(ctx, t, args)
+	case linux.VFIO_IOMMU_UNMAP_DMA:
+		return fd.iommuUnmapDMA(ctx, t, args)
 	}
 	return 0, linuxerr.ENOSYS
 }
 
+// getAPIVersion implements the VFIO_GET_API_VERSION ioctl, which takes no
+// arguments and always succeeds.
+func (fd *vfioFd) getAPIVersion() (uintptr, error) {
+	return uintptr(linux.VFIO_API_VERSION), nil
+}
+
+// setIOMMU implements the VFIO_SET_IOMMU ioctl, which sets the IOMMU model
+// used by all groups that have been added to this container via
+// VFIO_GROUP_SET_CONTAINER.
+func (fd *vfioFd) setIOMMU(iommuType extension) (uintptr, error) {
+	switch iommuType {
+	case linux.VFIO_TYPE1_IOMMU, linux.VFIO_SPAPR_TCE_IOMMU, linux.VFIO_TYPE1v2_IOMMU:
+		ret, err := ioctlInvoke[int32](fd.hostFd, linux.VFIO_SET_IOMMU, int32(iommuType))
+		if err != nil {
+			log.Warningf("set VFIO IOMMU %s: %v", iommuType, err)
+			return 0, err
+		}
+		fd.mu.Lock()
+		fd.iommuType = int32(iommuType)
+		fd.mu.Unlock()
+		return ret, nil
+	}
+	return 0, linuxerr.EINVAL
+}
+
 // checkExtension returns a positive integer when the given VFIO extension
 // is supported, otherwise, it returns 0.
 func (fd *vfioFd) checkExtension(ext extension) (uintptr, error) {
@@ -0,0 +1,199 @@
+// Copyright 2024 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tpuproxy
+
+import (
+	"golang.org/x/sys/unix"
+	"gvisor.dev/gvisor/pkg/abi/linux"
+	"gvisor.dev/gvisor/pkg/context"
+	"gvisor.dev/gvisor/pkg/errors/linuxerr"
+	"gvisor.dev/gvisor/pkg/hostarch"
+	"gvisor.dev/gvisor/pkg/log"
+	"gvisor.dev/gvisor/pkg/marshal/primitive"
+	"gvisor.dev/gvisor/pkg/sentry/arch"
+	"gvisor.dev/gvisor/pkg/sentry/kernel"
+	"gvisor.dev/gvisor/pkg/sentry/vfs"
+	"gvisor.dev/gvisor/pkg/usermem"
+)
+
+// newPCIDeviceFD wraps hostFd, a host VFIO device FD obtained via
+// VFIO_GROUP_GET_DEVICE_FD on container's group, in a sentry
+// vfs.FileDescription.
+func newPCIDeviceFD(ctx context.Context, t *kernel.Task, container *vfioFd, hostFd int) (*vfs.FileDescription, error) {
+	vfsObj := t.Kernel().VFS()
+	vd := vfsObj.NewAnonVirtualDentry("[vfio-device]")
+	defer vd.DecRef(ctx)
+
+	fd := &pciDeviceFD{
+		hostFD:    int32(hostFd),
+		container: container,
+	}
+	fd.memmapFile.fd = fd
+	if err := fd.vfsfd.Init(fd, unix.O_RDWR, vd.Mount(), vd.Dentry(), &vfs.FileDescriptionOptions{
+		UseDentryMetadata: true,
+		DenyPRead:         true,
+		DenyPWrite:        true,
+	}); err != nil {
+		return nil, err
+	}
+	return &fd.vfsfd, nil
+}
+
+// Ioctl implements vfs.FileDescriptionImpl.Ioctl.
+func (fd *pciDeviceFD) Ioctl(ctx context.Context, uio usermem.IO, sysno uintptr, args arch.SyscallArguments) (uintptr, error) {
+	cmd := args[1].Uint()
+	t := kernel.TaskFromContext(ctx)
+	if t == nil {
+		panic("Ioctl should be called from a task context")
+	}
+	switch cmd {
+	case linux.VFIO_DEVICE_GET_INFO:
+		return fd.getInfo(t, args)
+	case linux.VFIO_DEVICE_GET_REGION_INFO:
+		return fd.getRegionInfo(t, args)
+	case linux.VFIO_DEVICE_GET_IRQ_INFO:
+		return fd.getIRQInfo(t, args)
+	case linux.VFIO_DEVICE_SET_IRQS:
+		return fd.setIRQs(t, args)
+	case linux.VFIO_DEVICE_RESET:
+		return fd.reset()
+	}
+	return 0, linuxerr.ENOSYS
+}
+
+// getInfo implements the VFIO_DEVICE_GET_INFO ioctl.
+func (fd *pciDeviceFD) getInfo(t *kernel.Task, args arch.SyscallArguments) (uintptr, error) {
+	info := linux.VFIODeviceInfo{ArgSz: uint32(linux.VFIODeviceInfo{}.SizeBytes())}
+	if _, err := ioctlInvoke[*linux.VFIODeviceInfo](fd.hostFD, linux.VFIO_DEVICE_GET_INFO, &info); err != nil {
+		log.Warningf("get VFIO device info: %v", err)
+		return 0, err
+	}
+	if _, err := info.CopyOut(t, args[2].Pointer()); err != nil {
+		return 0, err
+	}
+	return 0, nil
+}
+
+// getRegionInfo implements the VFIO_DEVICE_GET_REGION_INFO ioctl. Callers
+// that request capability data (flagged by VFIO_REGION_INFO_FLAG_CAPS) by
+// passing an argsz larger than the fixed-size header are not yet supported;
+// the sentry only forwards the fixed-size vfio_region_info, mirroring the
+// region-info shape the existing pciDeviceFD mmap plumbing already relies
+// on.
+func (fd *pciDeviceFD) getRegionInfo(t *kernel.Task, args arch.SyscallArguments) (uintptr, error) {
+	addr := args[2].Pointer()
+	var region linux.VFIORegionInfo
+	if _, err := region.CopyIn(t, addr); err != nil {
+		return 0, err
+	}
+	region.ArgSz = uint32(region.SizeBytes())
+	region.CapOffset = 0
+	if _, err := ioctlInvoke[*linux.VFIORegionInfo](fd.hostFD, linux.VFIO_DEVICE_GET_REGION_INFO, &region); err != nil {
+		log.Warningf("get VFIO region info: %v", err)
+		return 0, err
+	}
+	if _, err := region.CopyOut(t, addr); err != nil {
+		return 0, err
+	}
+	return 0, nil
+}
+
+// getIRQInfo implements the VFIO_DEVICE_GET_IRQ_INFO ioctl.
+func (fd *pciDeviceFD) getIRQInfo(t *kernel.Task, args arch.SyscallArguments) (uintptr, error) {
+	addr := args[2].Pointer()
+	var irq linux.VFIOIrqInfo
+	if _, err := irq.CopyIn(t, addr); err != nil {
+		return 0, err
+	}
+	irq.ArgSz = uint32(irq.SizeBytes())
+	if _, err := ioctlInvoke[*linux.VFIOIrqInfo](fd.hostFD, linux.VFIO_DEVICE_GET_IRQ_INFO, &irq); err != nil {
+		log.Warningf("get VFIO IRQ info: %v", err)
+		return 0, err
+	}
+	if _, err := irq.CopyOut(t, addr); err != nil {
+		return 0, err
+	}
+	return 0, nil
+}
+
+// maxVFIOIRQSetCount bounds vfio_irq_set.count against the largest number of
+// IRQs any VFIO-capable device can plausibly expose (well above the 2048
+// MSI-X vectors PCIe allows), so that a malicious Count can't force a
+// multi-gigabyte allocation in setIRQs before the host ioctl has a chance to
+// reject it.
+const maxVFIOIRQSetCount = 4096
+
+// setIRQs implements the VFIO_DEVICE_SET_IRQS ioctl. The variable-length
+// `data` payload that follows the vfio_irq_set header (eventfds for
+// VFIO_IRQ_SET_DATA_EVENTFD, or one boolean byte per IRQ for
+// VFIO_IRQ_SET_DATA_BOOL) is
+// copied from the task and, for the eventfd case, each entry is translated
+// from a sentry FD into its backing host eventfd before being forwarded to
+// the host ioctl.
+func (fd *pciDeviceFD) setIRQs(t *kernel.Task, args arch.SyscallArguments) (uintptr, error) {
+	addr := args[2].Pointer()
+	var hdr linux.VFIOIrqSet
+	if _, err := hdr.CopyIn(t, addr); err != nil {
+		return 0, err
+	}
+	if hdr.Count > maxVFIOIRQSetCount {
+		return 0, linuxerr.EINVAL
+	}
+	dataAddr := hostarch.Addr(uint64(addr) + uint64(hdr.SizeBytes()))
+
+	switch {
+	case hdr.Flags&linux.VFIO_IRQ_SET_DATA_EVENTFD != 0:
+		sentryFDs := make([]int32, hdr.Count)
+		if hdr.Count > 0 {
+			if _, err := primitive.CopyInt32SliceIn(t, dataAddr, sentryFDs); err != nil {
+				return 0, err
+			}
+		}
+		hostFDs := make([]int32, hdr.Count)
+		for i, sfd := range sentryFDs {
+			if sfd < 0 {
+				hostFDs[i] = -1
+				continue
+			}
+			hostFD, err := eventFDHostFD(t, sfd)
+			if err != nil {
+				return 0, err
+			}
+			hostFDs[i] = hostFD
+		}
+		return ioctlSetIRQs(fd.hostFD, hdr, hostFDs)
+	case hdr.Flags&linux.VFIO_IRQ_SET_DATA_BOOL != 0:
+		data := make([]byte, hdr.Count)
+		if hdr.Count > 0 {
+			if _, err := t.CopyInBytes(dataAddr, data); err != nil {
+				return 0, err
+			}
+		}
+		return ioctlSetIRQsBytes(fd.hostFD, hdr, data)
+	default:
+		// VFIO_IRQ_SET_DATA_NONE (e.g. unmask/mask/trigger with no payload).
+		return ioctlSetIRQsBytes(fd.hostFD, hdr, nil)
+	}
+}
+
+// reset implements the VFIO_DEVICE_RESET ioctl.
+func (fd *pciDeviceFD) reset() (uintptr, error) {
+	ret, err := ioctlInvoke[int32](fd.hostFD, linux.VFIO_DEVICE_RESET, 0)
+	if err != nil {
+		log.Warningf("VFIO device reset: %v", err)
+		return 0, err
+	}
+	return ret, nil
+}
@@ -0,0 +1,347 @@
+// Copyright 2024 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tpuproxy
+
+import (
+	"sort"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+	"gvisor.dev/gvisor/pkg/abi/linux"
+	"gvisor.dev/gvisor/pkg/context"
+	"gvisor.dev/gvisor/pkg/errors/linuxerr"
+	"gvisor.dev/gvisor/pkg/hostarch"
+	"gvisor.dev/gvisor/pkg/log"
+	"gvisor.dev/gvisor/pkg/sentry/arch"
+	"gvisor.dev/gvisor/pkg/sentry/kernel"
+	"gvisor.dev/gvisor/pkg/sentry/memmap"
+)
+
+// vfioDMAPin is a single pinned memmap.File backing (part of) a DMA mapping.
+// It covers the IOVA range [iova, iova+size), which is backed by fr in file.
+type vfioDMAPin struct {
+	file memmap.File
+	fr   memmap.FileRange
+	iova uint64
+	size uint64
+}
+
+// vfioDMAMapping records an IOVA range mapped into a container's IOMMU via
+// VFIO_IOMMU_MAP_DMA, and the sentry memory pinned to back it. pins are
+// ordered by increasing iova and exactly tile [iova, iova+size).
+type vfioDMAMapping struct {
+	iova  uint64
+	size  uint64
+	flags uint32
+	pins  []vfioDMAPin
+}
+
+func (m *vfioDMAMapping) end() uint64 {
+	return m.iova + m.size
+}
+
+// unpin releases all sentry memory pinned for m. The host-side unmap (if
+// any) must already have happened.
+func (m *vfioDMAMapping) unpin() {
+	for _, p := range m.pins {
+		p.file.DecRef(p.fr)
+	}
+	m.pins = nil
+}
+
+// split partitions m's pins at the IOVA boundaries cutStart and cutEnd
+// (cutStart <= cutEnd), which need not be pin-aligned: a pin straddling
+// either boundary is itself split into sub-pins over the corresponding
+// sub-ranges of its memmap.FileRange. It returns the surviving mappings
+// covering [m.iova, cutStart) and [cutEnd, m.end()) (nil if empty), and a
+// mapping covering [cutStart, cutEnd) whose pins the caller must unpin once
+// the host-side unmap for that range has completed.
+func (m *vfioDMAMapping) split(cutStart, cutEnd uint64) (before, removed, after *vfioDMAMapping) {
+	before = &vfioDMAMapping{iova: m.iova, flags: m.flags}
+	removed = &vfioDMAMapping{iova: cutStart, flags: m.flags}
+	after = &vfioDMAMapping{iova: cutEnd, flags: m.flags}
+
+	for _, p := range m.pins {
+		pStart, pEnd := p.iova, p.iova+p.size
+		if pStart < cutStart {
+			before.pins = append(before.pins, subPin(p, pStart, min64(pEnd, cutStart)))
+		}
+		if rStart, rEnd := max64(pStart, cutStart), min64(pEnd, cutEnd); rStart < rEnd {
+			removed.pins = append(removed.pins, subPin(p, rStart, rEnd))
+		}
+		if pEnd > cutEnd {
+			after.pins = append(after.pins, subPin(p, max64(pStart, cutEnd), pEnd))
+		}
+	}
+	before.size = pinsLen(before.pins)
+	removed.size = pinsLen(removed.pins)
+	after.size = pinsLen(after.pins)
+
+	if before.size == 0 {
+		before = nil
+	}
+	if after.size == 0 {
+		after = nil
+	}
+	return before, removed, after
+}
+
+// subPin returns the portion of p covering the IOVA sub-range [start, end),
+// which must be contained within [p.iova, p.iova+p.size).
+func subPin(p vfioDMAPin, start, end uint64) vfioDMAPin {
+	return vfioDMAPin{
+		file: p.file,
+		fr: memmap.FileRange{
+			Start: p.fr.Start + (start - p.iova),
+			End:   p.fr.Start + (end - p.iova),
+		},
+		iova: start,
+		size: end - start,
+	}
+}
+
+// pinsLen returns the total IOVA length covered by pins.
+func pinsLen(pins []vfioDMAPin) uint64 {
+	var total uint64
+	for _, p := range pins {
+		total += p.size
+	}
+	return total
+}
+
+// iommuGetInfo implements the VFIO_IOMMU_GET_INFO ioctl.
+func (fd *vfioFd) iommuGetInfo(t *kernel.Task, args arch.SyscallArguments) (uintptr, error) {
+	info := linux.VFIOIommuType1Info{ArgSz: uint32(linux.VFIOIommuType1Info{}.SizeBytes())}
+	if _, err := ioctlInvoke[*linux.VFIOIommuType1Info](fd.hostFd, linux.VFIO_IOMMU_GET_INFO, &info); err != nil {
+		log.Warningf("get VFIO IOMMU info: %v", err)
+		return 0, err
+	}
+	if _, err := info.CopyOut(t, args[2].Pointer()); err != nil {
+		return 0, err
+	}
+	return 0, nil
+}
+
+// iommuMapDMA implements the VFIO_IOMMU_MAP_DMA ioctl: it pins the task
+// virtual address range given by req.Vaddr/req.Size, translates the pinned
+// backing memory into host virtual addresses, and programs the host IOMMU to
+// map them at req.IOVA via the host container FD.
+func (fd *vfioFd) iommuMapDMA(ctx context.Context, t *kernel.Task, args arch.SyscallArguments) (uintptr, error) {
+	addr := args[2].Pointer()
+	var req linux.VFIOIommuType1DmaMap
+	if _, err := req.CopyIn(t, addr); err != nil {
+		return 0, err
+	}
+
+	if req.Size == 0 || req.IOVA+req.Size <= req.IOVA {
+		return 0, linuxerr.EINVAL
+	}
+
+	fd.dmaMu.Lock()
+	defer fd.dmaMu.Unlock()
+	if fd.dmaOverlapsLocked(req.IOVA, req.Size) {
+		return 0, linuxerr.EEXIST
+	}
+
+	at := hostarch.AccessType{
+		Read:  req.Flags&linux.VFIO_DMA_MAP_FLAG_READ != 0,
+		Write: req.Flags&linux.VFIO_DMA_MAP_FLAG_WRITE != 0,
+	}
+	ar, ok := hostarch.Addr(req.Vaddr).ToRange(req.Size)
+	if !ok {
+		return 0, linuxerr.EINVAL
+	}
+	translations, err := t.MemoryManager().Translate(ctx, ar, at)
+	if err != nil {
+		return 0, err
+	}
+
+	mapping := &vfioDMAMapping{iova: req.IOVA, size: req.Size, flags: req.Flags}
+	iova := req.IOVA
+	for _, tr := range translations {
+		fr := tr.FileRange()
+		size := fr.Length()
+		tr.File.IncRef(fr, hostarch.PageSize)
+
+		hostVA, cleanup, err := mmapFileRange(tr.File, fr, at)
+		if err != nil {
+			tr.File.DecRef(fr)
+			fd.rollbackMapDMALocked(mapping)
+			return 0, err
+		}
+		dmaMap := linux.VFIOIommuType1DmaMap{
+			ArgSz: uint32(linux.VFIOIommuType1DmaMap{}.SizeBytes()),
+			Flags: req.Flags,
+			Vaddr: hostVA,
+			IOVA:  iova,
+			Size:  size,
+		}
+		_, ioctlErr := ioctlInvoke[*linux.VFIOIommuType1DmaMap](fd.hostFd, linux.VFIO_IOMMU_MAP_DMA, &dmaMap)
+		// The host mmap is only needed to let the host ioctl resolve vaddr to
+		// physical pages (which it pins itself); it need not stay mapped
+		// afterwards.
+		cleanup()
+		if ioctlErr != nil {
+			log.Warningf("VFIO IOMMU map DMA iova=%#x size=%#x: %v", iova, size, ioctlErr)
+			tr.File.DecRef(fr)
+			fd.rollbackMapDMALocked(mapping)
+			return 0, ioctlErr
+		}
+		mapping.pins = append(mapping.pins, vfioDMAPin{file: tr.File, fr: fr, iova: iova, size: size})
+		iova += size
+	}
+
+	fd.insertDMAMappingLocked(mapping)
+	return 0, nil
+}
+
+// rollbackMapDMALocked undoes the host IOMMU mappings and sentry pins
+// already established for mapping's pins, for use when a later translation
+// in the same VFIO_IOMMU_MAP_DMA call fails partway through. fd.dmaMu must
+// be locked, and mapping must not have been inserted into fd.dmaMappings.
+func (fd *vfioFd) rollbackMapDMALocked(mapping *vfioDMAMapping) {
+	for _, p := range mapping.pins {
+		unmap := linux.VFIOIommuType1DmaUnmap{
+			ArgSz: uint32(linux.VFIOIommuType1DmaUnmap{}.SizeBytes()),
+			IOVA:  p.iova,
+			Size:  p.size,
+		}
+		if _, err := ioctlInvoke[*linux.VFIOIommuType1DmaUnmap](fd.hostFd, linux.VFIO_IOMMU_UNMAP_DMA, &unmap); err != nil {
+			log.Warningf("rollback VFIO IOMMU unmap DMA iova=%#x size=%#x: %v", p.iova, p.size, err)
+		}
+	}
+	mapping.unpin()
+}
+
+// iommuUnmapDMA implements the VFIO_IOMMU_UNMAP_DMA ioctl. It supports
+// unmapping a range that exactly covers, is contained within, or spans
+// multiple prior VFIO_IOMMU_MAP_DMA calls, splitting the mappings at the
+// edges of the requested range as needed.
+func (fd *vfioFd) iommuUnmapDMA(ctx context.Context, t *kernel.Task, args arch.SyscallArguments) (uintptr, error) {
+	addr := args[2].Pointer()
+	var req linux.VFIOIommuType1DmaUnmap
+	if _, err := req.CopyIn(t, addr); err != nil {
+		return 0, err
+	}
+
+	if req.Size == 0 || req.IOVA+req.Size <= req.IOVA {
+		return 0, linuxerr.EINVAL
+	}
+
+	fd.dmaMu.Lock()
+	defer fd.dmaMu.Unlock()
+
+	unmapStart, unmapEnd := req.IOVA, req.IOVA+req.Size
+	var unmapped uint64
+	var kept []*vfioDMAMapping
+	for _, m := range fd.dmaMappings {
+		if m.end() <= unmapStart || m.iova >= unmapEnd {
+			kept = append(kept, m)
+			continue
+		}
+		// The host ioctl only needs to be told about the portion of m that
+		// overlaps the requested range; the host IOMMU mapping for any
+		// remaining portion of m is left untouched.
+		overlapStart, overlapEnd := max64(m.iova, unmapStart), min64(m.end(), unmapEnd)
+		hostUnmap := linux.VFIOIommuType1DmaUnmap{
+			ArgSz: uint32(linux.VFIOIommuType1DmaUnmap{}.SizeBytes()),
+			IOVA:  overlapStart,
+			Size:  overlapEnd - overlapStart,
+		}
+		if _, err := ioctlInvoke[*linux.VFIOIommuType1DmaUnmap](fd.hostFd, linux.VFIO_IOMMU_UNMAP_DMA, &hostUnmap); err != nil {
+			log.Warningf("VFIO IOMMU unmap DMA iova=%#x size=%#x: %v", hostUnmap.IOVA, hostUnmap.Size, err)
+			kept = append(kept, m)
+			continue
+		}
+		unmapped += hostUnmap.Size
+
+		// Only the portion of m actually torn down on the host is released
+		// here; any surviving sub-mapping stays in fd.dmaMappings so its
+		// pins remain tracked for a later UNMAP_DMA or Release.
+		before, removed, after := m.split(overlapStart, overlapEnd)
+		removed.unpin()
+		if before != nil {
+			kept = append(kept, before)
+		}
+		if after != nil {
+			kept = append(kept, after)
+		}
+	}
+	fd.dmaMappings = kept
+	sort.Slice(fd.dmaMappings, func(i, j int) bool { return fd.dmaMappings[i].iova < fd.dmaMappings[j].iova })
+
+	// Real VFIO_IOMMU_UNMAP_DMA callers (e.g. QEMU, DPDK) read back the
+	// actual unmapped size via req.Size for partial-unmap bookkeeping, not
+	// just the ioctl's return value.
+	req.Size = unmapped
+	if _, err := req.CopyOut(t, addr); err != nil {
+		return 0, err
+	}
+	return uintptr(unmapped), nil
+}
+
+// dmaOverlapsLocked returns true if [iova, iova+size) overlaps any existing
+// mapping. fd.dmaMu must be locked.
+func (fd *vfioFd) dmaOverlapsLocked(iova, size uint64) bool {
+	end := iova + size
+	for _, m := range fd.dmaMappings {
+		if iova < m.end() && m.iova < end {
+			return true
+		}
+	}
+	return false
+}
+
+// insertDMAMappingLocked inserts m into fd.dmaMappings, keeping the slice
+// sorted by IOVA. fd.dmaMu must be locked.
+func (fd *vfioFd) insertDMAMappingLocked(m *vfioDMAMapping) {
+	fd.dmaMappings = append(fd.dmaMappings, m)
+	sort.Slice(fd.dmaMappings, func(i, j int) bool { return fd.dmaMappings[i].iova < fd.dmaMappings[j].iova })
+}
+
+// mmapFileRange maps fr of file into the sentry's host address space for use
+// as the `vaddr` argument of a host VFIO_IOMMU_MAP_DMA ioctl, and returns a
+// cleanup function that unmaps it. The host driver pins the underlying
+// pages itself when servicing VFIO_IOMMU_MAP_DMA, so the caller only needs
+// this mapping to exist for the duration of that ioctl; cleanup should be
+// called once it has run, whether it succeeded or failed.
+func mmapFileRange(file memmap.File, fr memmap.FileRange, at hostarch.AccessType) (vaddr uint64, cleanup func(), err error) {
+	prot := 0
+	if at.Read {
+		prot |= unix.PROT_READ
+	}
+	if at.Write {
+		prot |= unix.PROT_WRITE
+	}
+	m, err := unix.Mmap(file.FD(), int64(fr.Start), int(fr.Length()), prot, unix.MAP_SHARED)
+	if err != nil {
+		return 0, nil, err
+	}
+	return uint64(uintptr(unsafe.Pointer(&m[0]))), func() { unix.Munmap(m) }, nil
+}
+
+func max64(a, b uint64) uint64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func min64(a, b uint64) uint64 {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,249 @@
+// Copyright 2024 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tpuproxy
+
+import (
+	"fmt"
+	"sync"
+
+	"golang.org/x/sys/unix"
+	"gvisor.dev/gvisor/pkg/abi/linux"
+	"gvisor.dev/gvisor/pkg/context"
+	"gvisor.dev/gvisor/pkg/errors/linuxerr"
+	"gvisor.dev/gvisor/pkg/fdnotifier"
+	"gvisor.dev/gvisor/pkg/log"
+	"gvisor.dev/gvisor/pkg/marshal/primitive"
+	"gvisor.dev/gvisor/pkg/sentry/arch"
+	"gvisor.dev/gvisor/pkg/sentry/kernel"
+	"gvisor.dev/gvisor/pkg/sentry/vfs"
+	"gvisor.dev/gvisor/pkg/usermem"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+// vfioGroupFD implements vfs.FileDescriptionImpl for an FD opened from
+// /dev/vfio/<groupid>.
+type vfioGroupFD struct {
+	vfsfd vfs.FileDescription
+	vfs.FileDescriptionDefaultImpl
+	vfs.DentryMetadataFileDescriptionImpl
+	vfs.NoLockFD
+
+	hostFd  int32
+	groupID uint32
+	queue   waiter.Queue
+
+	// mu protects container.
+	mu sync.Mutex
+
+	// container is the vfioFd this group has been added to via
+	// VFIO_GROUP_SET_CONTAINER, or nil if the group is not yet attached to a
+	// container.
+	container *vfioFd
+}
+
+// OpenVFIOGroup opens the host group device /dev/vfio/<groupID> and wraps
+// the resulting host FD in a vfioGroupFD, the sentry's representation of a
+// VFIO group FD.
+func OpenVFIOGroup(ctx context.Context, t *kernel.Task, groupID uint32) (*vfs.FileDescription, error) {
+	hostFd, err := unix.Open(fmt.Sprintf("/dev/vfio/%d", groupID), unix.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	newFD, err := newVfioGroupFD(ctx, t, groupID, int32(hostFd))
+	if err != nil {
+		unix.Close(hostFd)
+		return nil, err
+	}
+	return newFD, nil
+}
+
+// newVfioGroupFD wraps hostFd, a host FD obtained by opening
+// /dev/vfio/<groupID>, in a sentry vfs.FileDescription.
+func newVfioGroupFD(ctx context.Context, t *kernel.Task, groupID uint32, hostFd int32) (*vfs.FileDescription, error) {
+	vfsObj := t.Kernel().VFS()
+	vd := vfsObj.NewAnonVirtualDentry("[vfio-group]")
+	defer vd.DecRef(ctx)
+
+	fd := &vfioGroupFD{
+		hostFd:  hostFd,
+		groupID: groupID,
+	}
+	if err := fd.vfsfd.Init(fd, unix.O_RDWR, vd.Mount(), vd.Dentry(), &vfs.FileDescriptionOptions{
+		UseDentryMetadata: true,
+		DenyPRead:         true,
+		DenyPWrite:        true,
+	}); err != nil {
+		return nil, err
+	}
+	return &fd.vfsfd, nil
+}
+
+// Release implements vfs.FileDescriptionImpl.Release.
+func (fd *vfioGroupFD) Release(context.Context) {
+	fdnotifier.RemoveFD(fd.hostFd)
+	fd.queue.Notify(waiter.EventHUp)
+	unix.Close(int(fd.hostFd))
+}
+
+// EventRegister implements waiter.Waitable.EventRegister.
+func (fd *vfioGroupFD) EventRegister(e *waiter.Entry) error {
+	fd.queue.EventRegister(e)
+	if err := fdnotifier.UpdateFD(fd.hostFd); err != nil {
+		fd.queue.EventUnregister(e)
+		return err
+	}
+	return nil
+}
+
+// EventUnregister implements waiter.Waitable.EventUnregister.
+func (fd *vfioGroupFD) EventUnregister(e *waiter.Entry) {
+	fd.queue.EventUnregister(e)
+	if err := fdnotifier.UpdateFD(fd.hostFd); err != nil {
+		panic(err)
+	}
+}
+
+// Readiness implements waiter.Waitable.Readiness.
+func (fd *vfioGroupFD) Readiness(mask waiter.EventMask) waiter.EventMask {
+	return fdnotifier.NonBlockingPoll(fd.hostFd, mask)
+}
+
+// Epollable implements vfs.FileDescriptionImpl.Epollable.
+func (fd *vfioGroupFD) Epollable() bool {
+	return true
+}
+
+// Ioctl implements vfs.FileDescriptionImpl.Ioctl.
+func (fd *vfioGroupFD) Ioctl(ctx context.Context, uio usermem.IO, sysno uintptr, args arch.SyscallArguments) (uintptr, error) {
+	cmd := args[1].Uint()
+	t := kernel.TaskFromContext(ctx)
+	if t == nil {
+		panic("Ioctl should be called from a task context")
+	}
+	switch cmd {
+	case linux.VFIO_GROUP_GET_STATUS:
+		return fd.getStatus(t, args)
+	case linux.VFIO_GROUP_SET_CONTAINER:
+		return fd.setContainer(t, args)
+	case linux.VFIO_GROUP_UNSET_CONTAINER:
+		return fd.unsetContainer()
+	case linux.VFIO_GROUP_GET_DEVICE_FD:
+		return fd.getDeviceFD(ctx, t, args)
+	}
+	return 0, linuxerr.ENOSYS
+}
+
+// getStatus implements the VFIO_GROUP_GET_STATUS ioctl.
+func (fd *vfioGroupFD) getStatus(t *kernel.Task, args arch.SyscallArguments) (uintptr, error) {
+	status := linux.VFIOGroupStatus{ArgSz: uint32(linux.VFIOGroupStatus{}.SizeBytes())}
+	if _, err := ioctlInvoke[*linux.VFIOGroupStatus](fd.hostFd, linux.VFIO_GROUP_GET_STATUS, &status); err != nil {
+		log.Warningf("get VFIO group status: %v", err)
+		return 0, err
+	}
+	fd.mu.Lock()
+	hasContainer := fd.container != nil
+	fd.mu.Unlock()
+	if hasContainer {
+		status.Flags |= linux.VFIO_GROUP_FLAGS_CONTAINER_SET
+	}
+	statusAddr := args[2].Pointer()
+	if _, err := status.CopyOut(t, statusAddr); err != nil {
+		return 0, err
+	}
+	return 0, nil
+}
+
+// setContainer implements the VFIO_GROUP_SET_CONTAINER ioctl, which attaches
+// this group to the container identified by the int FD value pointed to by
+// args[2].
+func (fd *vfioGroupFD) setContainer(t *kernel.Task, args arch.SyscallArguments) (uintptr, error) {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	if fd.container != nil {
+		return 0, linuxerr.EINVAL
+	}
+	containerFDAddr := args[2].Pointer()
+	var containerFD int32
+	if _, err := primitive.CopyInt32In(t, containerFDAddr, &containerFD); err != nil {
+		return 0, err
+	}
+	file := t.GetFile(containerFD)
+	if file == nil {
+		return 0, linuxerr.EBADF
+	}
+	defer file.DecRef(t)
+	container, ok := file.Impl().(*vfioFd)
+	if !ok {
+		return 0, linuxerr.EINVAL
+	}
+	ret, err := ioctlInvoke[int32](fd.hostFd, linux.VFIO_GROUP_SET_CONTAINER, container.hostFd)
+	if err != nil {
+		log.Warningf("set VFIO group container: %v", err)
+		return 0, err
+	}
+	fd.container = container
+	return ret, nil
+}
+
+// unsetContainer implements the VFIO_GROUP_UNSET_CONTAINER ioctl.
+func (fd *vfioGroupFD) unsetContainer() (uintptr, error) {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	if fd.container == nil {
+		return 0, linuxerr.EINVAL
+	}
+	ret, err := ioctlInvoke[int32](fd.hostFd, linux.VFIO_GROUP_UNSET_CONTAINER, 0)
+	if err != nil {
+		log.Warningf("unset VFIO group container: %v", err)
+		return 0, err
+	}
+	fd.container = nil
+	return ret, nil
+}
+
+// getDeviceFD implements the VFIO_GROUP_GET_DEVICE_FD ioctl. It opens the
+// named device against the host group FD, wraps the resulting host FD in a
+// pciDeviceFD, and installs the new sentry FD into the calling task's FD
+// table.
+func (fd *vfioGroupFD) getDeviceFD(ctx context.Context, t *kernel.Task, args arch.SyscallArguments) (uintptr, error) {
+	fd.mu.Lock()
+	container := fd.container
+	fd.mu.Unlock()
+	if container == nil {
+		return 0, linuxerr.EINVAL
+	}
+	nameAddr := args[2].Pointer()
+	name, err := t.CopyInString(nameAddr, unix.PathMax)
+	if err != nil {
+		return 0, err
+	}
+	hostFd, err := ioctlGetDeviceFD(fd.hostFd, name)
+	if err != nil {
+		log.Warningf("get VFIO device fd for %q: %v", name, err)
+		return 0, err
+	}
+	newFD, err := newPCIDeviceFD(ctx, t, container, hostFd)
+	if err != nil {
+		unix.Close(hostFd)
+		return 0, err
+	}
+	fdFlags := kernel.FDFlags{CloseOnExec: false}
+	sentryFD, err := t.NewFDFrom(0, newFD, fdFlags)
+	if err != nil {
+		newFD.DecRef(ctx)
+		return 0, err
+	}
+	return uintptr(sentryFD), nil
+}
@@ -0,0 +1,85 @@
+// Copyright 2024 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tpuproxy
+
+import (
+	"encoding/binary"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+	"gvisor.dev/gvisor/pkg/abi/linux"
+	"gvisor.dev/gvisor/pkg/errors/linuxerr"
+	"gvisor.dev/gvisor/pkg/sentry/fsimpl/eventfd"
+	"gvisor.dev/gvisor/pkg/sentry/kernel"
+)
+
+// ioctlGetDeviceFD issues VFIO_GROUP_GET_DEVICE_FD against the host group
+// FD, passing the device name as a host-resident NUL-terminated string per
+// the VFIO UAPI (the command does not use an argsz-prefixed struct). It
+// returns the new host device FD on success.
+func ioctlGetDeviceFD(groupHostFd int32, name string) (int, error) {
+	namePtr, err := unix.BytePtrFromString(name)
+	if err != nil {
+		return 0, err
+	}
+	fd, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(groupHostFd), uintptr(linux.VFIO_GROUP_GET_DEVICE_FD), uintptr(unsafe.Pointer(namePtr)))
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(fd), nil
+}
+
+// eventFDHostFD returns the host FD backing the eventfd referenced by the
+// sentry FD sfd in t's FD table, for wiring into a host VFIO_DEVICE_SET_IRQS
+// ioctl.
+func eventFDHostFD(t *kernel.Task, sfd int32) (int32, error) {
+	file := t.GetFile(sfd)
+	if file == nil {
+		return 0, linuxerr.EBADF
+	}
+	defer file.DecRef(t)
+	efd, ok := file.Impl().(*eventfd.EventFileDescription)
+	if !ok {
+		return 0, linuxerr.EINVAL
+	}
+	return efd.HostFD(), nil
+}
+
+// ioctlSetIRQsBytes issues VFIO_DEVICE_SET_IRQS against the host device FD
+// hostFd, appending the raw data payload (interpreted per hdr.Flags) after
+// the marshaled vfio_irq_set header, as required by the argsz-prefixed VFIO
+// UAPI.
+func ioctlSetIRQsBytes(hostFd int32, hdr linux.VFIOIrqSet, data []byte) (uintptr, error) {
+	hdr.ArgSz = uint32(hdr.SizeBytes() + len(data))
+	buf := make([]byte, hdr.SizeBytes()+len(data))
+	hdr.MarshalBytes(buf[:hdr.SizeBytes()])
+	copy(buf[hdr.SizeBytes():], data)
+	ret, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(hostFd), uintptr(linux.VFIO_DEVICE_SET_IRQS), uintptr(unsafe.Pointer(&buf[0])))
+	if errno != 0 {
+		return 0, errno
+	}
+	return ret, nil
+}
+
+// ioctlSetIRQs is a convenience wrapper around ioctlSetIRQsBytes for the
+// VFIO_IRQ_SET_DATA_EVENTFD case, where the payload is an array of host
+// eventfd FDs.
+func ioctlSetIRQs(hostFd int32, hdr linux.VFIOIrqSet, hostFDs []int32) (uintptr, error) {
+	data := make([]byte, len(hostFDs)*4)
+	for i, v := range hostFDs {
+		binary.LittleEndian.PutUint32(data[i*4:], uint32(v))
+	}
+	return ioctlSetIRQsBytes(hostFd, hdr, data)
+}